@@ -1,16 +1,24 @@
 package smtp
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/smtp"
 	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/internal/choice"
 	internaltls "github.com/influxdata/telegraf/internal/tls"
 	"github.com/influxdata/telegraf/plugins/inputs"
 	"github.com/influxdata/wlog"
@@ -32,10 +40,12 @@ const (
 	Connect  Operation = "connect"
 	Ehlo               = "ehlo"
 	StartTls           = "starttls"
+	Auth               = "auth"
 	MailFrom           = "from"
 	RcptTo             = "to"
 	Data               = "data"
 	Body               = "body"
+	Rset               = "rset"
 	Quit               = "quit"
 )
 
@@ -50,7 +60,81 @@ type Smtp struct {
 	Body        string
 	StartTls    bool
 
+	MessagesPerSession int
+
+	AuthExternal bool
+	AuthIdentity string
+
+	HealthStatus bool
+	HealthStates map[string]string
+
+	TargetsFile string
+
+	SupportBundleTrigger string
+	SupportBundleDir     string
+
 	internaltls.ClientConfig
+
+	// sessions running in the background, shared with the targets
+	sessions *sessions
+
+	// targets loaded from the targets file
+	targets []*Smtp
+	// hash of the content the targets were loaded from
+	targetsHash [sha256.Size]byte
+
+	// diagnostics collected while generating a support bundle
+	bundle *supportBundle
+}
+
+// sessions tracks the sessions running in the background between Start and
+// Stop, they report their metrics to the accumulator given to Start
+type sessions struct {
+	acc telegraf.Accumulator
+	wg  sync.WaitGroup
+
+	mutex       sync.Mutex
+	stopped     bool
+	connections map[net.Conn]bool
+	// state of the targets by address, so that it is kept when the targets
+	// file is reloaded
+	targets map[string]*targetState
+}
+
+// targetState tracks the sessions against a target
+type targetState struct {
+	running bool
+	// number of gathers skipped because a session was still in flight
+	skippedGathers uint64
+}
+
+// target holds the options of a target read from the targets file.
+// Options which are not set fall back to the values configured for the plugin.
+type target struct {
+	Address            string `json:"address"`
+	Timeout            string `json:"timeout"`
+	ReadTimeout        string `json:"read_timeout"`
+	Ehlo               string `json:"ehlo"`
+	From               string `json:"from"`
+	To                 string `json:"to"`
+	Body               string `json:"body"`
+	MessagesPerSession *int   `json:"messages_per_session"`
+	StartTls           *bool  `json:"starttls"`
+	AuthExternal       *bool  `json:"auth_external"`
+	AuthIdentity       string `json:"auth_identity"`
+}
+
+// healthLevels are the states a result can be classified as
+var healthLevels = []string{"ok", "warning", "critical"}
+
+// healthStatuses holds the status message reported for each result
+var healthStatuses = map[string]string{
+	"success":           "SMTP session completed successfully",
+	"timeout":           "Timed out waiting for server response",
+	"connection_failed": "Failed to connect to server",
+	"read_failed":       "Failed to read server response",
+	"string_mismatch":   "Server returned an unexpected response code",
+	"tls_config_error":  "Invalid TLS configuration",
 }
 
 var description = "Automates an entire SMTP session and reports metrics"
@@ -82,9 +166,44 @@ var sampleConfig = `
   ## Optional value to provide to data command
   # body = "this is a test payload"
 
+  ## Optional number of messages to send in each session, between messages
+  ## the "rset" command is issued. Requires from to be set.
+  # messages_per_session = 1
+
   ## Optional whether to issue "starttls" command
   # starttls = false
 
+  ## Optional whether to issue "auth external" after "starttls", requires
+  ## starttls and a client certificate configured with tls_cert and tls_key
+  # auth_external = false
+
+  ## Optional authorization identity to request with "auth external", the
+  ## server must map the client certificate to this identity to accept it
+  # auth_identity = "me@example.com"
+
+  ## Optional health classification of the result, adds a "state" tag
+  ## (ok, warning or critical) and a "status" message field.
+  ## Success is classified as ok and every other result as critical.
+  # health_status = false
+
+  ## Override the state of individual results
+  # [inputs.smtp.health_states]
+  #   timeout = "warning"
+
+  ## Optional JSON file listing the targets to probe instead of address.
+  ## The file is reloaded when it changes and environment variables in it
+  ## are expanded. Each target requires an address and can override the
+  ## timeout, read_timeout, ehlo, from, to, body, messages_per_session,
+  ## starttls, auth_external and auth_identity options set here.
+  # targets_file = "/etc/telegraf/smtp_targets.json"
+
+  ## Optional support bundle generation. When the trigger file exists the
+  ## target whose address it contains, or the plugin's address if empty, is
+  ## probed with full diagnostics and a JSON support bundle is written to
+  ## support_bundle_dir. The trigger file is removed afterwards.
+  # support_bundle_trigger = "/var/run/telegraf/smtp_support_bundle"
+  # support_bundle_dir = "/tmp"
+
   ## Optional TLS Config
   # tls_ca = "/etc/telegraf/ca.pem"
   # tls_cert = "/etc/telegraf/cert.pem"
@@ -114,6 +233,14 @@ func (config *Smtp) SMTPGather() (tags map[string]string, fields map[string]inte
 		return tags, fields
 	}
 	defer conn.Close()
+	if config.sessions != nil {
+		// Stop closes the connection to interrupt the session
+		config.sessions.track(conn)
+		defer config.sessions.untrack(conn)
+	}
+	if config.bundle != nil {
+		conn = config.bundle.recordConnection(conn, time.Since(start))
+	}
 	conn.SetReadDeadline(time.Now().Add(config.ReadTimeout.Duration))
 	// Prepare client
 	host, _, _ := net.SplitHostPort(config.Address)
@@ -148,16 +275,105 @@ func (config *Smtp) SMTPGather() (tags map[string]string, fields map[string]inte
 			setResult(TlsConfigError, fields, tags)
 			success = false
 		} else {
-			if err := client.StartTLS(tlsConfig); err != nil {
+			if config.bundle != nil {
+				// the session continues on a new client which records the transcript in the clear
+				client, err = config.bundle.startTLS(client, conn, host, config.Ehlo, tlsConfig)
+			} else {
+				err = client.StartTLS(tlsConfig)
+			}
+			if err != nil {
 				setErrorMetrics(StartTls, err, fields, tags)
 				success = false
 			} else {
 				setResponseCodeMetric(StartTls, 220, fields, tags)
 			}
 		}
+
+		if success && config.AuthExternal {
+			if len(tlsConfig.Certificates) == 0 {
+				// auth external relies on the client certificate presented during the handshake
+				logMsg("No client certificate configured for 'auth' operation")
+				setResult(TlsConfigError, fields, tags)
+				success = false
+			} else if err := client.Auth(&externalAuth{identity: config.AuthIdentity}); err != nil {
+				setErrorMetrics(Auth, err, fields, tags)
+				success = false
+			} else {
+				setResponseCodeMetric(Auth, 235, fields, tags)
+			}
+		}
+	} else if success && config.AuthExternal {
+		// auth external relies on the client certificate presented during the starttls handshake
+		logMsg("The 'auth' operation requires starttls")
+		setResult(TlsConfigError, fields, tags)
+		success = false
+	}
+
+	// Send the configured number of messages, resetting the session between them
+	messages := 1
+	if config.MessagesPerSession > 1 {
+		messages = config.MessagesPerSession
+	}
+	var sent int
+	var messageTime time.Duration
+	for i := 0; success && i < messages; i++ {
+		if i > 0 {
+			// the read timeout applies to each message rather than the entire batch
+			conn.SetReadDeadline(time.Now().Add(config.ReadTimeout.Duration))
+			if err := client.Reset(); err != nil {
+				setErrorMetrics(Rset, err, fields, tags)
+				success = false
+				break
+			}
+			setResponseCodeMetric(Rset, 250, fields, tags)
+			// only report the codes of the last message attempted
+			for _, operation := range []Operation{MailFrom, RcptTo, Data, Body} {
+				delete(fields, string(operation)+"_code")
+			}
+		}
+		messageStart := time.Now()
+		success = config.sendMessage(client, fields, tags)
+		if success {
+			messageTime += time.Since(messageStart)
+			sent++
+		}
+	}
+
+	// always execute the quit command
+	if success {
+		if err := client.Quit(); err != nil {
+			setErrorMetrics(Quit, err, fields, tags)
+			success = false
+		} else {
+			setResponseCodeMetric(Quit, 221, fields, tags)
+		}
+	} else {
+		// attempt to cleanly close the connection but don't store extra metrics
+		client.Quit()
+	}
+
+	if success {
+		// set the final success result if everything went well
+		setResult(Success, fields, tags)
+	}
+	responseTime = time.Since(start).Seconds()
+	fields["total_time"] = responseTime
+	if messages > 1 {
+		fields["messages_sent"] = sent
+		if sent > 0 {
+			fields["message_time"] = messageTime.Seconds() / float64(sent)
+		}
+		fields["messages_per_second"] = float64(sent) / responseTime
 	}
+	return tags, fields
+}
 
-	if success && config.From != "" {
+// sendMessage executes a single mail transaction with the mailfrom, rcptto and data commands.
+// It will return false if any of the commands failed
+func (config *Smtp) sendMessage(client *smtp.Client, fields map[string]interface{}, tags map[string]string) bool {
+	var success bool = true
+
+	if config.From != "" {
 		if err := client.Mail(config.From); err != nil {
 			setErrorMetrics(MailFrom, err, fields, tags)
 			success = false
@@ -197,26 +413,28 @@ func (config *Smtp) SMTPGather() (tags map[string]string, fields map[string]inte
 		}
 	}
 
-	// always execute the quit command
-	if success {
-		if err := client.Quit(); err != nil {
-			setErrorMetrics(Quit, err, fields, tags)
-			success = false
-		} else {
-			setResponseCodeMetric(Quit, 221, fields, tags)
-		}
-	} else {
-		// attempt to cleanly close the connection but don't store extra metrics
-		client.Quit()
-	}
+	return success
+}
 
-	if success {
-		// set the final success result if everything went well
-		setResult(Success, fields, tags)
+// externalAuth implements the SASL EXTERNAL mechanism, the server authenticates
+// the client using the certificate it presented during the TLS handshake.
+type externalAuth struct {
+	identity string
+}
+
+func (a *externalAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "EXTERNAL", []byte(a.identity), nil
+}
+
+func (a *externalAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// an empty challenge asks for the initial response, any other challenge is unexpected
+		if len(fromServer) != 0 {
+			return nil, errors.New("unexpected server challenge")
+		}
+		return []byte{}, nil
 	}
-	responseTime = time.Since(start).Seconds()
-	fields["total_time"] = responseTime
-	return tags, fields
+	return nil, nil
 }
 
 func setErrorMetrics(operation Operation, err error, fields map[string]interface{}, tags map[string]string) {
@@ -268,14 +486,173 @@ func setResult(result ResultType, fields map[string]interface{}, tags map[string
 	tags["result"] = tag
 }
 
+// validateHealthStates checks the configured results and states are known
+func (config *Smtp) validateHealthStates() error {
+	for result, state := range config.HealthStates {
+		if _, ok := healthStatuses[result]; !ok {
+			return fmt.Errorf("unknown result %q in health_states", result)
+		}
+		if !choice.Contains(state, healthLevels) {
+			return fmt.Errorf("unknown state %q for result %q in health_states", state, result)
+		}
+	}
+	return nil
+}
+
+// validateMessagesPerSession checks the options needed to send several messages are set
+func (config *Smtp) validateMessagesPerSession() error {
+	// without "mail from" there is no mail transaction to repeat
+	if config.MessagesPerSession > 1 && config.From == "" {
+		return errors.New("messages_per_session requires from to be set")
+	}
+	return nil
+}
+
+// setHealthStatus classifies the result into a state and adds its status message
+func (config *Smtp) setHealthStatus(fields map[string]interface{}, tags map[string]string) {
+	result := tags["result"]
+	state, ok := config.HealthStates[result]
+	if !ok {
+		if result == "success" {
+			state = "ok"
+		} else {
+			state = "critical"
+		}
+	}
+
+	tags["state"] = state
+	fields["status"] = healthStatuses[result]
+}
+
 func logMsg(msg string) {
 	if wlog.LogLevel() == wlog.DEBUG {
 		log.Println("smtp: " + msg)
 	}
 }
 
+// state returns the state of the target, the caller must hold the mutex of the sessions
+func (smtp *Smtp) state() *targetState {
+	state, ok := smtp.sessions.targets[smtp.Address]
+	if !ok {
+		state = &targetState{}
+		smtp.sessions.targets[smtp.Address] = state
+	}
+	return state
+}
+
+// acquire marks the target as having a session running.
+// It returns false if the previous session has not finished yet.
+func (smtp *Smtp) acquire() bool {
+	smtp.sessions.mutex.Lock()
+	defer smtp.sessions.mutex.Unlock()
+	state := smtp.state()
+	if state.running {
+		return false
+	}
+	state.running = true
+	return true
+}
+
+// release clears the mark set by acquire
+func (smtp *Smtp) release() {
+	smtp.sessions.mutex.Lock()
+	defer smtp.sessions.mutex.Unlock()
+	smtp.state().running = false
+}
+
+// skip counts a gather skipped because a session was still in flight.
+// It returns the number of gathers skipped so far.
+func (smtp *Smtp) skip() uint64 {
+	smtp.sessions.mutex.Lock()
+	defer smtp.sessions.mutex.Unlock()
+	state := smtp.state()
+	state.skippedGathers++
+	return state.skippedGathers
+}
+
+// skippedGathers returns the number of gathers skipped against the target
+func (smtp *Smtp) skippedGathers() uint64 {
+	smtp.sessions.mutex.Lock()
+	defer smtp.sessions.mutex.Unlock()
+	return smtp.state().skippedGathers
+}
+
+// track registers the connection of a session so that Stop can close it.
+// The connection is closed right away if the plugin was already stopped.
+func (s *sessions) track(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		conn.Close()
+		return
+	}
+	s.connections[conn] = true
+}
+
+func (s *sessions) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.connections, conn)
+}
+
+// addFields adds the metrics of a session. The metrics of a session
+// interrupted by Stop are discarded since the accumulator is no longer valid.
+func (s *sessions) addFields(fields map[string]interface{}, tags map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return
+	}
+	s.acc.AddFields("smtp", fields, tags)
+}
+
+// addError adds the error of a background task unless the plugin was stopped
+func (s *sessions) addError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return
+	}
+	s.acc.AddError(err)
+}
+
+// interrupted returns true once Stop was called
+func (s *sessions) interrupted() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stopped
+}
+
+// stop closes the connections of the running sessions and waits for them to finish
+func (s *sessions) stop() {
+	s.mutex.Lock()
+	s.stopped = true
+	for conn := range s.connections {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+// Start is called by telegraf before the first gather. The sessions run in the
+// background and add their metrics to acc once they complete.
+func (smtp *Smtp) Start(acc telegraf.Accumulator) error {
+	smtp.sessions = &sessions{
+		acc:         acc,
+		connections: make(map[net.Conn]bool),
+		targets:     make(map[string]*targetState),
+	}
+	return nil
+}
+
+// Stop interrupts the sessions still running and waits for them to finish
+func (smtp *Smtp) Stop() {
+	smtp.sessions.stop()
+}
+
 // Gather is called by telegraf when the plugin is executed on its interval.
-// It will call SMTPGather to generate metrics and also fill an Accumulator that is supplied.
+// It starts the sessions which call SMTPGather to generate metrics, errors
+// are added to the Accumulator that is supplied.
 func (smtp *Smtp) Gather(acc telegraf.Accumulator) error {
 	// Set default values
 	if smtp.Timeout.Duration == 0 {
@@ -284,6 +661,32 @@ func (smtp *Smtp) Gather(acc telegraf.Accumulator) error {
 	if smtp.ReadTimeout.Duration == 0 {
 		smtp.ReadTimeout.Duration = time.Second * 10
 	}
+	if smtp.TargetsFile != "" {
+		// Reload the targets if the file changed, the previous targets are kept on failure
+		if err := smtp.loadTargets(); err != nil {
+			acc.AddError(err)
+		}
+	}
+	// Start a support bundle if one was requested, this is done before the
+	// sessions are started so the target is not busy with this gather's session
+	if smtp.SupportBundleTrigger != "" {
+		if err := smtp.handleSupportBundle(); err != nil {
+			acc.AddError(err)
+		}
+	}
+	if smtp.TargetsFile == "" {
+		return smtp.gatherTarget()
+	}
+	for _, target := range smtp.targets {
+		acc.AddError(target.gatherTarget())
+	}
+	return nil
+}
+
+// gatherTarget starts the session against the configured address in the background
+// so that a slow server does not hold up the next gather. The session adds its
+// metrics to the accumulator given to Start once it completes.
+func (smtp *Smtp) gatherTarget() error {
 	// Prepare host and port
 	host, port, err := net.SplitHostPort(smtp.Address)
 	if err != nil {
@@ -295,18 +698,178 @@ func (smtp *Smtp) Gather(acc telegraf.Accumulator) error {
 	if port == "" {
 		return errors.New("Bad port")
 	}
-	// Prepare data
-	tags := map[string]string{"server": host, "port": port}
-	var fields map[string]interface{}
-	var returnTags map[string]string
-	// Gather data
-	returnTags, fields = smtp.SMTPGather()
-	// Merge the tags
-	for k, v := range returnTags {
-		tags[k] = v
-	}
-	// Add metrics
-	acc.AddFields("smtp", fields, tags)
+	// Skip this gather if the previous session against the server has not finished yet
+	if !smtp.acquire() {
+		skipped := smtp.skip()
+		log.Printf("W! smtp: Skipping gather, previous session against %s is still running (%d skipped)",
+			smtp.Address, skipped)
+		return nil
+	}
+	sessions := smtp.sessions
+	sessions.wg.Add(1)
+	go func() {
+		defer sessions.wg.Done()
+		// Prepare data
+		tags := map[string]string{"server": host, "port": port}
+		var fields map[string]interface{}
+		var returnTags map[string]string
+		// Gather data
+		returnTags, fields = smtp.SMTPGather()
+		fields["skipped_gathers"] = smtp.skippedGathers()
+		// the next gather may start a new session as soon as this one has finished
+		smtp.release()
+		// Merge the tags
+		for k, v := range returnTags {
+			tags[k] = v
+		}
+		if smtp.HealthStatus {
+			smtp.setHealthStatus(fields, tags)
+		}
+		// Add metrics
+		sessions.addFields(fields, tags)
+	}()
+	return nil
+}
+
+// envVarRe matches the environment variables in the options of a target
+var envVarRe = regexp.MustCompile(`\$\{(\w+)\}|\$(\w+)`)
+
+// expandEnv replaces the environment variables in the string options of the
+// target. Variables which are not set are left unchanged.
+func (t *target) expandEnv() {
+	options := []*string{&t.Address, &t.Timeout, &t.ReadTimeout, &t.Ehlo, &t.From, &t.To, &t.Body, &t.AuthIdentity}
+	for _, option := range options {
+		*option = envVarRe.ReplaceAllStringFunc(*option, func(match string) string {
+			if value, ok := os.LookupEnv(strings.Trim(match, "${}")); ok {
+				return value
+			}
+			return match
+		})
+	}
+}
+
+// loadTargets reads the targets file and reloads the targets if its content changed
+func (smtp *Smtp) loadTargets() error {
+	data, err := ioutil.ReadFile(smtp.TargetsFile)
+	if err != nil {
+		return err
+	}
+	// the content is compared since the modification time misses rewrites within
+	// its resolution and is kept by tools such as "cp -p" or "rsync -t"
+	hash := sha256.Sum256(data)
+	if smtp.targets != nil && hash == smtp.targetsHash {
+		return nil
+	}
+	var entries []target
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("could not parse targets file %s: %v", smtp.TargetsFile, err)
+	}
+
+	targets := make([]*Smtp, 0, len(entries))
+	addresses := make(map[string]bool)
+	for _, entry := range entries {
+		entry.expandEnv()
+		t, err := smtp.newTarget(entry)
+		if err == nil && addresses[t.Address] {
+			// the metrics and the state of the sessions are identified by address
+			err = fmt.Errorf("%s: duplicate address", t.Address)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid target in targets file %s: %v", smtp.TargetsFile, err)
+		}
+		addresses[t.Address] = true
+		targets = append(targets, t)
+	}
+
+	smtp.targets = targets
+	smtp.targetsHash = hash
+	log.Printf("I! smtp: Loaded %d targets from %s", len(targets), smtp.TargetsFile)
+	return nil
+}
+
+// copyConfig returns a new instance with the session options of the plugin
+func (smtp *Smtp) copyConfig() *Smtp {
+	return &Smtp{
+		Address:            smtp.Address,
+		Timeout:            smtp.Timeout,
+		ReadTimeout:        smtp.ReadTimeout,
+		Ehlo:               smtp.Ehlo,
+		From:               smtp.From,
+		To:                 smtp.To,
+		Body:               smtp.Body,
+		StartTls:           smtp.StartTls,
+		MessagesPerSession: smtp.MessagesPerSession,
+		AuthExternal:       smtp.AuthExternal,
+		AuthIdentity:       smtp.AuthIdentity,
+		HealthStatus:       smtp.HealthStatus,
+		HealthStates:       smtp.HealthStates,
+		ClientConfig:       smtp.ClientConfig,
+		sessions:           smtp.sessions,
+	}
+}
+
+// newTarget creates the plugin configuration of a target, using the plugin's
+// own configuration for the options the target does not set
+func (smtp *Smtp) newTarget(entry target) (*Smtp, error) {
+	if entry.Address == "" {
+		return nil, errors.New("missing address")
+	}
+	t := smtp.copyConfig()
+	t.Address = entry.Address
+
+	if entry.Timeout != "" {
+		d, err := time.ParseDuration(entry.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Address, err)
+		}
+		t.Timeout.Duration = d
+	}
+	if entry.ReadTimeout != "" {
+		d, err := time.ParseDuration(entry.ReadTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Address, err)
+		}
+		t.ReadTimeout.Duration = d
+	}
+	if entry.Ehlo != "" {
+		t.Ehlo = entry.Ehlo
+	}
+	if entry.From != "" {
+		t.From = entry.From
+	}
+	if entry.To != "" {
+		t.To = entry.To
+	}
+	if entry.Body != "" {
+		t.Body = entry.Body
+	}
+	if entry.MessagesPerSession != nil {
+		t.MessagesPerSession = *entry.MessagesPerSession
+	}
+	if entry.StartTls != nil {
+		t.StartTls = *entry.StartTls
+	}
+	if entry.AuthExternal != nil {
+		t.AuthExternal = *entry.AuthExternal
+	}
+	if entry.AuthIdentity != "" {
+		t.AuthIdentity = entry.AuthIdentity
+	}
+	if err := t.validateMessagesPerSession(); err != nil {
+		return nil, fmt.Errorf("%s: %v", entry.Address, err)
+	}
+	return t, nil
+}
+
+// Init validates the configuration when the plugin is loaded
+func (smtp *Smtp) Init() error {
+	if err := smtp.validateHealthStates(); err != nil {
+		return err
+	}
+	// with a targets file the options are defaults, each target is checked once loaded
+	if smtp.TargetsFile == "" {
+		return smtp.validateMessagesPerSession()
+	}
 	return nil
 }
 
@@ -3,8 +3,10 @@ package smtp
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/base64"
 	internaltls "github.com/influxdata/telegraf/internal/tls"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"os"
@@ -23,12 +25,22 @@ import (
 
 var pki = testutil.NewPKI("../../../testutil/pki")
 
+// identity the test server maps the client certificate to
+const authorizedIdentity = "me2@test.com"
+
 type testConfig struct {
 	// defines the step at which the connection should close
 	// the connection will close directly before the given step is executed
 	connectionEndPhase ConnectionEndPhase
 	tls                bool
 	tlsInsecure        bool
+	clientCert         bool
+	authIdentity       string
+	healthStatus       bool
+	// number of messages sent by the client in each session
+	messagesPerSession int
+	// number of messages the server accepts before rejecting "mail from"
+	messageLimit int
 }
 
 type ConnectionEndPhase int
@@ -84,8 +96,11 @@ func TestConnectionError(t *testing.T) {
 	var acc testutil.Accumulator
 	// Init plugin
 	c := getDefaultSmtpConfig()
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
 	// Error
 	err1 := c.Gather(&acc)
+	acc.Wait(1)
 	for _, p := range acc.Metrics {
 		p.Fields["connect_time"] = 1.0
 		p.Fields["total_time"] = 2.0
@@ -94,9 +109,10 @@ func TestConnectionError(t *testing.T) {
 	acc.AssertContainsTaggedFields(t,
 		"smtp",
 		map[string]interface{}{
-			"result_code":  uint64(2),
-			"connect_time": 1.0,
-			"total_time":   2.0,
+			"result_code":     uint64(2),
+			"connect_time":    1.0,
+			"total_time":      2.0,
+			"skipped_gathers": uint64(0),
 		},
 		map[string]string{
 			"result": "connection_failed",
@@ -106,6 +122,294 @@ func TestConnectionError(t *testing.T) {
 	)
 }
 
+func TestSkipGatherWhenInFlight(t *testing.T) {
+	var wg sync.WaitGroup
+	var acc testutil.Accumulator
+	// Init plugin
+	c := getDefaultSmtpConfig()
+
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	// Start TCP server which never sends its greeting
+	wg.Add(1)
+	go SmtpServer(t, &wg, testConfig{connectionEndPhase: ConnectionTimeout})
+	wg.Wait()
+	wg.Add(1)
+	// The first session waits for the greeting until the read timeout
+	require.NoError(t, c.Gather(&acc))
+	// The next gather starts while the first session is still open
+	require.NoError(t, c.Gather(&acc))
+	assert.Equal(t, uint64(0), acc.NMetrics())
+	assert.Equal(t, uint64(1), c.skippedGathers())
+	// The first session reports the skipped gather once it completes
+	acc.Wait(1)
+	wg.Wait()
+	for _, p := range acc.Metrics {
+		p.Fields["connect_time"] = 1.0
+		p.Fields["total_time"] = 2.0
+	}
+	fields, tags := getFieldsAndTags("timeout", 1, false)
+	fields["skipped_gathers"] = uint64(1)
+	acc.AssertContainsTaggedFields(t, "smtp", fields, tags)
+}
+
+func TestStopInterruptsSession(t *testing.T) {
+	var wg sync.WaitGroup
+	var acc testutil.Accumulator
+	// Init plugin
+	c := getDefaultSmtpConfig()
+	require.NoError(t, c.Start(&acc))
+
+	// Start TCP server which never sends its greeting
+	wg.Add(1)
+	go SmtpServer(t, &wg, testConfig{connectionEndPhase: ConnectionTimeout})
+	wg.Wait()
+	wg.Add(1)
+	require.NoError(t, c.Gather(&acc))
+	// Stop closes the connection rather than waiting for the read timeout
+	start := time.Now()
+	c.Stop()
+	assert.True(t, time.Since(start) < c.ReadTimeout.Duration)
+	// The interrupted session adds no metrics, not even once the server gives up
+	wg.Wait()
+	assert.Equal(t, uint64(0), acc.NMetrics())
+	assert.NoError(t, acc.FirstError())
+}
+
+func TestHealthStatus_Override(t *testing.T) {
+	var acc testutil.Accumulator
+	// Init plugin
+	c := getDefaultSmtpConfig()
+	c.HealthStatus = true
+	c.HealthStates = map[string]string{"connection_failed": "warning"}
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+	// Error
+	err1 := c.Gather(&acc)
+	acc.Wait(1)
+	for _, p := range acc.Metrics {
+		p.Fields["connect_time"] = 1.0
+		p.Fields["total_time"] = 2.0
+	}
+	require.NoError(t, err1)
+	acc.AssertContainsTaggedFields(t,
+		"smtp",
+		map[string]interface{}{
+			"result_code":     uint64(2),
+			"connect_time":    1.0,
+			"total_time":      2.0,
+			"skipped_gathers": uint64(0),
+			"status":          "Failed to connect to server",
+		},
+		map[string]string{
+			"result": "connection_failed",
+			"state":  "warning",
+			"server": "127.0.0.1",
+			"port":   "2004",
+		},
+	)
+}
+
+func TestHealthStatus_InvalidStates(t *testing.T) {
+	c := getDefaultSmtpConfig()
+	c.HealthStatus = true
+	c.HealthStates = map[string]string{"timeout": "broken"}
+	err1 := c.Init()
+	require.Error(t, err1)
+	assert.Equal(t, `unknown state "broken" for result "timeout" in health_states`, err1.Error())
+
+	c.HealthStates = map[string]string{"slow": "warning"}
+	err2 := c.Init()
+	require.Error(t, err2)
+	assert.Equal(t, `unknown result "slow" in health_states`, err2.Error())
+
+	c.HealthStates = map[string]string{"timeout": "warning"}
+	assert.NoError(t, c.Init())
+}
+
+func TestTargetsFile_Session(t *testing.T) {
+	var wg sync.WaitGroup
+	var acc testutil.Accumulator
+	// The target overrides the plugin configuration, partly from the environment
+	os.Setenv("SMTP_TEST_FROM", "me2@test.com")
+	defer os.Unsetenv("SMTP_TEST_FROM")
+	targetsFile := writeTargetsFile(t, `[
+		{"address": "127.0.0.1:2004", "read_timeout": "2s", "from": "${SMTP_TEST_FROM}", "to": "me3@test.com"}
+	]`)
+	defer os.Remove(targetsFile)
+	c := Smtp{
+		Timeout:     internal.Duration{Duration: time.Second},
+		Ehlo:        "me@test.com",
+		Body:        "testdata 12345",
+		TargetsFile: targetsFile,
+	}
+
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	// Start TCP server
+	wg.Add(1)
+	go SmtpServer(t, &wg, testConfig{})
+	wg.Wait()
+	// Connect
+	wg.Add(1)
+	err1 := c.Gather(&acc)
+	acc.Wait(1)
+	wg.Wait()
+	// Override response time
+	for _, p := range acc.Metrics {
+		p.Fields["connect_time"] = 1.0
+		p.Fields["total_time"] = 2.0
+	}
+	require.NoError(t, err1)
+	require.NoError(t, acc.FirstError())
+	fields, tags := getFieldsAndTags("success", 0, false, 220, 250, 250, 250, 354, 250, 221)
+	acc.AssertContainsTaggedFields(t, "smtp", fields, tags)
+}
+
+func TestTargetsFile_Reload(t *testing.T) {
+	var acc testutil.Accumulator
+	targetsFile := writeTargetsFile(t, `[{"address": "127.0.0.1:2005"}]`)
+	defer os.Remove(targetsFile)
+	c := Smtp{
+		Timeout:     internal.Duration{Duration: time.Second},
+		TargetsFile: targetsFile,
+	}
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+	require.NoError(t, c.Gather(&acc))
+	acc.Wait(1)
+	require.NoError(t, acc.FirstError())
+	assert.Equal(t, "2005", acc.Metrics[0].Tags["port"])
+
+	// An invalid file is reported and the previous targets are kept
+	acc.ClearMetrics()
+	updateTargetsFile(t, targetsFile, `[{"address": "127.0.0.1:2005"`)
+	require.NoError(t, c.Gather(&acc))
+	acc.Wait(1)
+	require.Error(t, acc.FirstError())
+	require.Len(t, acc.Metrics, 1)
+	assert.Equal(t, "2005", acc.Metrics[0].Tags["port"])
+
+	// A changed file replaces the targets
+	acc.ClearMetrics()
+	acc.Errors = nil
+	updateTargetsFile(t, targetsFile, `[{"address": "127.0.0.1:2006"}]`)
+	require.NoError(t, c.Gather(&acc))
+	acc.Wait(1)
+	require.NoError(t, acc.FirstError())
+	require.Len(t, acc.Metrics, 1)
+	assert.Equal(t, "2006", acc.Metrics[0].Tags["port"])
+	assert.Equal(t, "connection_failed", acc.Metrics[0].Tags["result"])
+}
+
+func TestTargetsFile_ReloadSameModTime(t *testing.T) {
+	targetsFile := writeTargetsFile(t, `[{"address": "127.0.0.1:2005"}]`)
+	defer os.Remove(targetsFile)
+	info, err := os.Stat(targetsFile)
+	require.NoError(t, err)
+	c := Smtp{TargetsFile: targetsFile}
+	require.NoError(t, c.loadTargets())
+	// An unchanged file is not reloaded
+	previous := c.targets
+	require.NoError(t, c.loadTargets())
+	assert.True(t, c.targets[0] == previous[0])
+
+	// A rewrite which keeps the modification time, as "cp -p" does, is detected
+	updateTargetsFile(t, targetsFile, `[{"address": "127.0.0.1:2006"}]`)
+	require.NoError(t, os.Chtimes(targetsFile, info.ModTime(), info.ModTime()))
+	require.NoError(t, c.loadTargets())
+	require.Len(t, c.targets, 1)
+	assert.Equal(t, "127.0.0.1:2006", c.targets[0].Address)
+}
+
+func TestTargetsFile_ExpandEnv(t *testing.T) {
+	// Values are expanded after parsing so they cannot break the JSON
+	os.Setenv("SMTP_TEST_FROM", `me"2\@test.com`)
+	defer os.Unsetenv("SMTP_TEST_FROM")
+	targetsFile := writeTargetsFile(t, `[
+		{"address": "127.0.0.1:2005", "from": "${SMTP_TEST_FROM}", "body": "cost $5"}
+	]`)
+	defer os.Remove(targetsFile)
+	c := Smtp{TargetsFile: targetsFile}
+	require.NoError(t, c.loadTargets())
+	require.Len(t, c.targets, 1)
+	assert.Equal(t, `me"2\@test.com`, c.targets[0].From)
+	// variables which are not set are left unchanged
+	assert.Equal(t, "cost $5", c.targets[0].Body)
+}
+
+func TestTargetsFile_ReloadKeepsState(t *testing.T) {
+	var acc testutil.Accumulator
+	targetsFile := writeTargetsFile(t, `[{"address": "127.0.0.1:2005"}]`)
+	defer os.Remove(targetsFile)
+	c := Smtp{TargetsFile: targetsFile}
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+	require.NoError(t, c.loadTargets())
+	// Simulate a session which is still running against the target
+	require.True(t, c.targets[0].acquire())
+	require.NoError(t, c.targets[0].gatherTarget())
+
+	// The changed target does not start a session while the previous one is running
+	updateTargetsFile(t, targetsFile, `[{"address": "127.0.0.1:2005", "from": "me@test.com"}]`)
+	require.NoError(t, c.loadTargets())
+	require.Len(t, c.targets, 1)
+	assert.Equal(t, "me@test.com", c.targets[0].From)
+	require.NoError(t, c.targets[0].gatherTarget())
+	assert.Equal(t, uint64(2), c.targets[0].skippedGathers())
+	assert.Equal(t, uint64(0), acc.NMetrics())
+	c.targets[0].release()
+}
+
+func TestTargetsFile_DuplicateAddress(t *testing.T) {
+	targetsFile := writeTargetsFile(t, `[
+		{"address": "127.0.0.1:2005"},
+		{"address": "127.0.0.1:2005", "from": "me@test.com"}
+	]`)
+	defer os.Remove(targetsFile)
+	c := Smtp{TargetsFile: targetsFile}
+	err := c.loadTargets()
+	require.Error(t, err)
+	assert.Equal(t, "invalid target in targets file "+targetsFile+": 127.0.0.1:2005: duplicate address", err.Error())
+	assert.Len(t, c.targets, 0)
+}
+
+func TestTargetsFile_MissingAddress(t *testing.T) {
+	var acc testutil.Accumulator
+	targetsFile := writeTargetsFile(t, `[{"from": "me@test.com"}]`)
+	defer os.Remove(targetsFile)
+	c := Smtp{TargetsFile: targetsFile}
+	require.NoError(t, c.Gather(&acc))
+	require.Error(t, acc.FirstError())
+	assert.Equal(t, "invalid target in targets file "+targetsFile+": missing address", acc.FirstError().Error())
+	assert.Equal(t, uint64(0), acc.NMetrics())
+}
+
+func TestTargetsFile_MessagesPerSessionRequiresFrom(t *testing.T) {
+	targetsFile := writeTargetsFile(t, `[{"address": "127.0.0.1:2005", "messages_per_session": 3}]`)
+	defer os.Remove(targetsFile)
+	c := Smtp{TargetsFile: targetsFile}
+	err := c.loadTargets()
+	require.Error(t, err)
+	assert.Equal(t, "invalid target in targets file "+targetsFile+
+		": 127.0.0.1:2005: messages_per_session requires from to be set", err.Error())
+}
+
+func writeTargetsFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "smtp_targets")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func updateTargetsFile(t *testing.T, path string, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
 func testSmtpHelper(t *testing.T, testConfig testConfig, fields map[string]interface{}, tags map[string]string) {
 	var wg sync.WaitGroup
 	var acc testutil.Accumulator
@@ -114,6 +418,19 @@ func testSmtpHelper(t *testing.T, testConfig testConfig, fields map[string]inter
 	if testConfig.tls {
 		c = getTlsSmtp(testConfig.tlsInsecure)
 	}
+	if testConfig.clientCert {
+		c.TLSCert = pki.ClientCertPath()
+		c.TLSKey = pki.ClientKeyPath()
+	}
+	if testConfig.authIdentity != "" {
+		c.AuthExternal = true
+		c.AuthIdentity = testConfig.authIdentity
+	}
+	c.HealthStatus = testConfig.healthStatus
+	c.MessagesPerSession = testConfig.messagesPerSession
+
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
 
 	// Start TCP server
 	wg.Add(1)
@@ -122,11 +439,18 @@ func testSmtpHelper(t *testing.T, testConfig testConfig, fields map[string]inter
 	// Connect
 	wg.Add(1)
 	err1 := c.Gather(&acc)
+	acc.Wait(1)
 	wg.Wait()
 	// Override response time
 	for _, p := range acc.Metrics {
 		p.Fields["connect_time"] = 1.0
 		p.Fields["total_time"] = 2.0
+		if _, ok := p.Fields["message_time"]; ok {
+			p.Fields["message_time"] = 3.0
+		}
+		if _, ok := p.Fields["messages_per_second"]; ok {
+			p.Fields["messages_per_second"] = 4.0
+		}
 	}
 	require.NoError(t, err1)
 	acc.AssertContainsTaggedFields(t, "smtp", fields, tags)
@@ -137,6 +461,53 @@ func TestSmtpFullSession_Success(t *testing.T) {
 	testSmtpHelper(t, testConfig{}, fields, tags)
 }
 
+func TestSmtpFullSession_HealthStatus(t *testing.T) {
+	fields, tags := getFieldsAndTags("success", 0, false, 220, 250, 250, 250, 354, 250, 221)
+	fields["status"] = "SMTP session completed successfully"
+	tags["state"] = "ok"
+	testSmtpHelper(t, testConfig{healthStatus: true}, fields, tags)
+}
+
+func TestSmtp_FailTo_HealthStatus(t *testing.T) {
+	fields, tags := getFieldsAndTags("string_mismatch", 4, false, 220, 250, 250, 424)
+	fields["status"] = "Server returned an unexpected response code"
+	tags["state"] = "critical"
+	testConfig := testConfig{connectionEndPhase: FailTo, healthStatus: true}
+	testSmtpHelper(t, testConfig, fields, tags)
+}
+
+func TestSmtpMultipleMessages_Success(t *testing.T) {
+	fields, tags := getFieldsAndTags("success", 0, false, 220, 250, 250, 250, 354, 250, 221)
+	fields["rset_code"] = 250
+	fields["messages_sent"] = 3
+	fields["message_time"] = 3.0
+	fields["messages_per_second"] = 4.0
+	testConfig := testConfig{messagesPerSession: 3}
+	testSmtpHelper(t, testConfig, fields, tags)
+}
+
+func TestSmtpMultipleMessages_RateLimited(t *testing.T) {
+	fields, tags := getFieldsAndTags("string_mismatch", 4, false, 220, 250, 450)
+	fields["rset_code"] = 250
+	fields["messages_sent"] = 2
+	fields["message_time"] = 3.0
+	fields["messages_per_second"] = 4.0
+	testConfig := testConfig{messagesPerSession: 3, messageLimit: 2}
+	testSmtpHelper(t, testConfig, fields, tags)
+}
+
+func TestMessagesPerSession_RequiresFrom(t *testing.T) {
+	c := getDefaultSmtpConfig()
+	c.From = ""
+	c.MessagesPerSession = 3
+	err1 := c.Init()
+	require.Error(t, err1)
+	assert.Equal(t, "messages_per_session requires from to be set", err1.Error())
+
+	c.MessagesPerSession = 1
+	assert.NoError(t, c.Init())
+}
+
 func TestSmtpTlsSession_Success(t *testing.T) {
 	fields, tags := getFieldsAndTags("success", 0, true, 220, 250, 220, 250, 250, 354, 250, 221)
 	testConfig := testConfig{
@@ -157,6 +528,49 @@ func TestSmtpSecureTlsSession_Fail(t *testing.T) {
 	testSmtpHelper(t, testConfig, fields, tags)
 }
 
+func TestSmtpAuthExternal_Success(t *testing.T) {
+	fields, tags := getFieldsAndTags("success", 0, true, 220, 250, 220, 250, 250, 354, 250, 221)
+	fields["auth_code"] = 235
+	testConfig := testConfig{
+		tls:          true,
+		tlsInsecure:  true,
+		clientCert:   true,
+		authIdentity: authorizedIdentity,
+	}
+	testSmtpHelper(t, testConfig, fields, tags)
+}
+
+func TestSmtpAuthExternal_Rejected(t *testing.T) {
+	fields, tags := getFieldsAndTags("string_mismatch", 4, true, 220, 250, 220)
+	fields["auth_code"] = 535
+	testConfig := testConfig{
+		tls:          true,
+		tlsInsecure:  true,
+		clientCert:   true,
+		authIdentity: "someone@test.com",
+	}
+	testSmtpHelper(t, testConfig, fields, tags)
+}
+
+func TestSmtpAuthExternal_NoClientCert(t *testing.T) {
+	fields, tags := getFieldsAndTags("tls_config_error", 5, true, 220, 250, 220)
+	testConfig := testConfig{
+		tls:          true,
+		tlsInsecure:  true,
+		authIdentity: authorizedIdentity,
+	}
+	testSmtpHelper(t, testConfig, fields, tags)
+}
+
+func TestSmtpAuthExternal_NoStartTls(t *testing.T) {
+	fields, tags := getFieldsAndTags("tls_config_error", 5, false, 220, 250)
+	testConfig := testConfig{
+		clientCert:   true,
+		authIdentity: authorizedIdentity,
+	}
+	testSmtpHelper(t, testConfig, fields, tags)
+}
+
 func TestSmtp_FailTimeoutConnection(t *testing.T) {
 	fields, tags := getFieldsAndTags("timeout", 1, false)
 	testConfig := testConfig{connectionEndPhase: ConnectionTimeout}
@@ -220,9 +634,10 @@ func getFieldsAndTags(status string, result int, tls bool, codes ...int) (fields
 	}
 
 	fields = map[string]interface{}{
-		"result_code":  uint64(result),
-		"connect_time": 1.0,
-		"total_time":   2.0,
+		"result_code":     uint64(result),
+		"connect_time":    1.0,
+		"total_time":      2.0,
+		"skipped_gathers": uint64(0),
 	}
 	tags = map[string]string{
 		"result": status,
@@ -249,6 +664,8 @@ func SmtpServer(t *testing.T, wg *sync.WaitGroup, config testConfig) {
 
 	tcpServer, err := net.Listen("tcp", "127.0.0.1:2004")
 	require.NoError(t, err)
+	// the end of the session is signaled once the port is released for the next test
+	defer wg.Done()
 	defer tcpServer.Close()
 	wg.Done()
 
@@ -258,10 +675,10 @@ func SmtpServer(t *testing.T, wg *sync.WaitGroup, config testConfig) {
 
 	reader := bufio.NewReader(conn)
 	tp := textproto.NewReader(reader)
+	messages := 0
 
 	if config.connectionEndPhase == ConnectionTimeout {
 		time.Sleep(getDefaultSmtpConfig().ReadTimeout.Duration + time.Second)
-		wg.Done()
 		return
 	}
 
@@ -318,17 +735,35 @@ func SmtpServer(t *testing.T, wg *sync.WaitGroup, config testConfig) {
 				reader := bufio.NewReader(conn)
 				tp = textproto.NewReader(reader)
 			}
+		} else if strings.HasPrefix(data, "AUTH EXTERNAL") {
+			// accept only if a client certificate was presented and the requested identity is authorized
+			identity, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(data, "AUTH EXTERNAL")))
+			tlsConn, ok := conn.(*tls.Conn)
+			if ok && len(tlsConn.ConnectionState().PeerCertificates) > 0 && string(identity) == authorizedIdentity {
+				conn.Write([]byte("235 2.7.0 Authentication successful\r\n"))
+			} else {
+				conn.Write([]byte("535 5.7.8 Authentication credentials invalid\r\n"))
+			}
+		} else if data == "*" {
+			// the client aborts the authentication exchange after a rejection
+			conn.Write([]byte("501 5.7.0 Authentication aborted\r\n"))
 		} else if config.connectionEndPhase == FailFrom {
 			conn.Write([]byte("423 This is a fake error\r\n"))
 		} else if strings.HasPrefix(data, "MAIL FROM:") {
-			conn.Write([]byte("250 2.1.0 Ok\r\n"))
+			messages++
+			if config.messageLimit > 0 && messages > config.messageLimit {
+				conn.Write([]byte("450 4.7.1 Error: too much mail\r\n"))
+			} else {
+				conn.Write([]byte("250 2.1.0 Ok\r\n"))
+			}
+		} else if strings.HasPrefix(data, "RSET") {
+			conn.Write([]byte("250 2.0.0 Ok\r\n"))
 		} else if config.connectionEndPhase == FailTo {
 			conn.Write([]byte("424 This is a fake error\r\n"))
 		} else if strings.HasPrefix(data, "RCPT TO:") {
 			conn.Write([]byte("250 2.1.5 Ok\r\n"))
 		} else if config.connectionEndPhase == LateTimeout {
 			time.Sleep(getDefaultSmtpConfig().ReadTimeout.Duration + time.Second)
-			wg.Done()
 			return
 		} else if config.connectionEndPhase == FailData {
 			conn.Write([]byte("425 This is a fake error\r\n"))
@@ -340,7 +775,6 @@ func SmtpServer(t *testing.T, wg *sync.WaitGroup, config testConfig) {
 			conn.Write([]byte("250 2.0.0 Ok: queued as C7CAA3F279\r\n"))
 		}
 	}
-	wg.Done()
 }
 
 func getDefaultSmtpConfig() Smtp {
@@ -370,6 +804,7 @@ func getTlsServerConfig() *tls.Config {
 	config := &tls.Config{
 		InsecureSkipVerify: false,
 		Certificates:       []tls.Certificate{pair},
+		ClientAuth:         tls.RequestClientCert,
 	}
 	return config
 }
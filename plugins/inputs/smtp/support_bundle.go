@@ -0,0 +1,432 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errInterrupted = errors.New("the session was interrupted")
+
+// supportBundle holds the diagnostics collected while probing a single target
+type supportBundle struct {
+	// time the connection was established, the transcript is timed relative to it
+	start time.Time
+
+	Target     string                 `json:"target"`
+	Time       time.Time              `json:"time"`
+	Options    target                 `json:"options"`
+	DNS        []dnsLookup            `json:"dns"`
+	TCP        *tcpDetails            `json:"tcp,omitempty"`
+	TLS        *tlsDetails            `json:"tls,omitempty"`
+	Transcript []transcriptEntry      `json:"transcript"`
+	Tags       map[string]string      `json:"tags"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+type dnsLookup struct {
+	Type     string   `json:"type"`
+	Name     string   `json:"name"`
+	Result   []string `json:"result,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Duration float64  `json:"duration"`
+}
+
+type tcpDetails struct {
+	LocalAddress  string  `json:"local_address"`
+	RemoteAddress string  `json:"remote_address"`
+	ConnectTime   float64 `json:"connect_time"`
+}
+
+type tlsDetails struct {
+	Version          string               `json:"version"`
+	CipherSuite      string               `json:"cipher_suite"`
+	ServerName       string               `json:"server_name"`
+	PeerCertificates []certificateDetails `json:"peer_certificates"`
+}
+
+type certificateDetails struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+type transcriptEntry struct {
+	// seconds since the connection was established
+	Time      float64 `json:"time"`
+	Direction string  `json:"direction"`
+	Data      string  `json:"data"`
+}
+
+// transcriptConn records the data exchanged over the connection into the bundle.
+// Only the size of message payloads is recorded. Once the server accepted the
+// starttls command, the data is recorded by the connection on top of TLS instead.
+type transcriptConn struct {
+	net.Conn
+	bundle    *supportBundle
+	starttls  bool
+	encrypted bool
+	data      bool
+	payload   bool
+	// end of the payload sent so far, to detect its terminating line
+	payloadTail string
+
+	// transcript entry which sizes are being added to
+	summaryIndex int
+	summaryKind  string
+	summaryBytes int
+}
+
+func (c *transcriptConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record("server", b[:n])
+	}
+	return n, err
+}
+
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record("client", b[:n])
+	}
+	return n, err
+}
+
+func (c *transcriptConn) record(direction string, data []byte) {
+	if c.encrypted {
+		return
+	}
+	if c.payload && direction == "client" {
+		c.summarize(direction, "message data", len(data))
+		// the payload ends with a line holding a single dot
+		c.payloadTail += string(data)
+		if len(c.payloadTail) > 5 {
+			c.payloadTail = c.payloadTail[len(c.payloadTail)-5:]
+		}
+		if c.payloadTail == "\r\n.\r\n" {
+			c.payload = false
+			c.payloadTail = ""
+		}
+		return
+	}
+
+	c.bundle.Transcript = append(c.bundle.Transcript, transcriptEntry{
+		Time:      time.Since(c.bundle.start).Seconds(),
+		Direction: direction,
+		Data:      string(data),
+	})
+
+	command := strings.ToUpper(string(data))
+	switch {
+	case direction == "client" && strings.HasPrefix(command, "STARTTLS"):
+		c.starttls = true
+	case direction == "client" && strings.HasPrefix(command, "DATA"):
+		c.data = true
+	case direction == "server" && c.starttls:
+		c.starttls = false
+		c.encrypted = strings.HasPrefix(string(data), "220")
+	case direction == "server" && c.data:
+		c.data = false
+		c.payload = strings.HasPrefix(string(data), "354")
+		// the line ending of the data command also starts the payload
+		c.payloadTail = "\r\n"
+	}
+}
+
+// summarize records the size of the data rather than its content. Consecutive
+// data of the same kind and direction is added to a single entry.
+func (c *transcriptConn) summarize(direction string, kind string, n int) {
+	last := len(c.bundle.Transcript) - 1
+	if last >= 0 && last == c.summaryIndex && c.summaryKind == direction+" "+kind {
+		c.summaryBytes += n
+	} else {
+		c.bundle.Transcript = append(c.bundle.Transcript, transcriptEntry{
+			Time:      time.Since(c.bundle.start).Seconds(),
+			Direction: direction,
+		})
+		c.summaryIndex = last + 1
+		c.summaryKind = direction + " " + kind
+		c.summaryBytes = n
+	}
+	c.bundle.Transcript[c.summaryIndex].Data = fmt.Sprintf("[%d bytes %s]", c.summaryBytes, kind)
+}
+
+// recordConnection stores the connection details and returns the connection
+// wrapped to record the transcript
+func (b *supportBundle) recordConnection(conn net.Conn, connectTime time.Duration) net.Conn {
+	b.TCP = &tcpDetails{
+		LocalAddress:  conn.LocalAddr().String(),
+		RemoteAddress: conn.RemoteAddr().String(),
+		ConnectTime:   connectTime.Seconds(),
+	}
+	b.start = time.Now()
+	return &transcriptConn{Conn: conn, bundle: b}
+}
+
+// greetingConn replays the greeting smtp.NewClient reads before the session
+// continues on the connection. It is not part of the transcript.
+type greetingConn struct {
+	net.Conn
+	greeting *strings.Reader
+}
+
+func (c *greetingConn) Read(b []byte) (int, error) {
+	if c.greeting.Len() > 0 {
+		return c.greeting.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// startTLS issues the starttls command like smtp.Client.StartTLS, but records the
+// transcript on top of the TLS connection so the rest of the session is readable.
+// It returns the client to continue the session with, or the given client on failure.
+func (b *supportBundle) startTLS(client *smtp.Client, conn net.Conn, host string, localName string, config *tls.Config) (*smtp.Client, error) {
+	if localName == "" {
+		// smtp.Client.StartTLS greets the server first if ehlo was not sent yet
+		localName = "localhost"
+		if err := client.Hello(localName); err != nil {
+			return client, err
+		}
+	}
+	id, err := client.Text.Cmd("STARTTLS")
+	if err != nil {
+		return client, err
+	}
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(220)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return client, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return client, err
+	}
+	b.recordTLS(tlsConn.ConnectionState())
+	// the server only greets the client before starttls
+	greeting := strings.NewReader("220 " + host + "\r\n")
+	recorded := &transcriptConn{Conn: tlsConn, bundle: b}
+	tlsClient, err := smtp.NewClient(&greetingConn{Conn: recorded, greeting: greeting}, host)
+	if err != nil {
+		return client, err
+	}
+	// the session continues with ehlo, as with smtp.Client.StartTLS
+	if err := tlsClient.Hello(localName); err != nil {
+		return client, err
+	}
+	return tlsClient, nil
+}
+
+// recordTLS stores the details of the negotiated TLS session
+func (b *supportBundle) recordTLS(state tls.ConnectionState) {
+	b.TLS = &tlsDetails{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: fmt.Sprintf("0x%04x", state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	for _, cert := range state.PeerCertificates {
+		b.TLS.PeerCertificates = append(b.TLS.PeerCertificates, certificateDetails{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			DNSNames:  cert.DNSNames,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+}
+
+// traceDNS resolves the host and records every lookup with its duration.
+// Each lookup has its own timeout so a slow lookup does not fail the next ones.
+func (b *supportBundle) traceDNS(host string, timeout time.Duration) {
+	resolver := net.DefaultResolver
+
+	if net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		cname, err := resolver.LookupCNAME(ctx, host)
+		cancel()
+		b.addLookup("CNAME", host, []string{cname}, err, start)
+
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		start = time.Now()
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		cancel()
+		var ips []string
+		for _, addr := range addrs {
+			ips = append(ips, addr.String())
+		}
+		b.addLookup("A/AAAA", host, ips, err, start)
+		if err != nil {
+			return
+		}
+		host = ips[0]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	names, err := resolver.LookupAddr(ctx, host)
+	b.addLookup("PTR", host, names, err, start)
+}
+
+func (b *supportBundle) addLookup(lookupType string, name string, result []string, err error, start time.Time) {
+	lookup := dnsLookup{
+		Type:     lookupType,
+		Name:     name,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		lookup.Error = err.Error()
+	} else {
+		lookup.Result = result
+	}
+	b.DNS = append(b.DNS, lookup)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS10"
+	case tls.VersionTLS11:
+		return "TLS11"
+	case tls.VersionTLS12:
+		return "TLS12"
+	case tls.VersionTLS13:
+		return "TLS13"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// handleSupportBundle starts writing a support bundle for the target named in
+// the trigger file if it exists. The bundle is written in the background in
+// place of the target's regular session, the trigger file is removed once
+// the bundle is written.
+func (smtp *Smtp) handleSupportBundle() error {
+	data, err := ioutil.ReadFile(smtp.SupportBundleTrigger)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	address := strings.TrimSpace(string(data))
+	target := smtp.findTarget(address)
+	if target == nil {
+		os.Remove(smtp.SupportBundleTrigger)
+		return fmt.Errorf("support bundle requested for unknown target %q", address)
+	}
+	if !target.acquire() {
+		// keep the trigger to retry on the next interval
+		log.Printf("W! smtp: Delaying support bundle for %s, a session against the target is still running",
+			target.Address)
+		return nil
+	}
+	sessions := smtp.sessions
+	sessions.wg.Add(1)
+	go func() {
+		defer sessions.wg.Done()
+		defer target.release()
+		path, err := target.writeSupportBundle(smtp.SupportBundleDir)
+		if err == errInterrupted {
+			// keep the trigger to write the bundle once telegraf runs again
+			return
+		}
+		os.Remove(smtp.SupportBundleTrigger)
+		if err != nil {
+			sessions.addError(fmt.Errorf("could not write support bundle for %s: %v", target.Address, err))
+			return
+		}
+		log.Printf("I! smtp: Wrote support bundle for %s to %s", target.Address, path)
+	}()
+	return nil
+}
+
+// findTarget returns the target with the given address.
+// Without a targets file an empty address selects the plugin's own address.
+func (smtp *Smtp) findTarget(address string) *Smtp {
+	if smtp.TargetsFile == "" {
+		if address == "" || address == smtp.Address {
+			return smtp
+		}
+		return nil
+	}
+	for _, t := range smtp.targets {
+		if t.Address == address {
+			return t
+		}
+	}
+	return nil
+}
+
+// writeSupportBundle probes the target with full diagnostics and writes the
+// bundle as JSON into dir. It returns the path of the bundle. The caller must
+// hold the target with acquire.
+func (smtp *Smtp) writeSupportBundle(dir string) (string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	host, _, err := net.SplitHostPort(smtp.Address)
+	if err != nil {
+		return "", err
+	}
+	bundle := &supportBundle{
+		Target:  smtp.Address,
+		Time:    time.Now().UTC(),
+		Options: smtp.options(),
+	}
+	bundle.traceDNS(host, smtp.Timeout.Duration)
+	// probe a copy of the target so the diagnostics do not affect its regular gathers
+	probe := smtp.copyConfig()
+	probe.bundle = bundle
+	bundle.Tags, bundle.Fields = probe.SMTPGather()
+	if smtp.sessions.interrupted() {
+		return "", errInterrupted
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(smtp.Address)
+	path := filepath.Join(dir, fmt.Sprintf("smtp_support_bundle_%s_%s.json",
+		name, bundle.Time.Format("20060102T150405Z")))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// options returns the session options of the target in the targets file format
+func (smtp *Smtp) options() target {
+	messagesPerSession := smtp.MessagesPerSession
+	startTls := smtp.StartTls
+	authExternal := smtp.AuthExternal
+	return target{
+		Address:            smtp.Address,
+		Timeout:            smtp.Timeout.Duration.String(),
+		ReadTimeout:        smtp.ReadTimeout.Duration.String(),
+		Ehlo:               smtp.Ehlo,
+		From:               smtp.From,
+		To:                 smtp.To,
+		Body:               smtp.Body,
+		MessagesPerSession: &messagesPerSession,
+		StartTls:           &startTls,
+		AuthExternal:       &authExternal,
+		AuthIdentity:       smtp.AuthIdentity,
+	}
+}
@@ -0,0 +1,247 @@
+package smtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSupportBundle(t *testing.T) {
+	var wg sync.WaitGroup
+	var acc testutil.Accumulator
+	dir, err := ioutil.TempDir("", "smtp_support_bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := getTlsSmtp(true)
+
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	// Start TCP server
+	wg.Add(1)
+	go SmtpServer(t, &wg, testConfig{tls: true, tlsInsecure: true})
+	wg.Wait()
+	// Connect
+	wg.Add(1)
+	path, err := c.writeSupportBundle(dir)
+	wg.Wait()
+	require.NoError(t, err)
+	assert.Equal(t, dir, filepath.Dir(path))
+	assert.True(t, strings.HasPrefix(filepath.Base(path), "smtp_support_bundle_127.0.0.1_2004_"))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var bundle supportBundle
+	require.NoError(t, json.Unmarshal(data, &bundle))
+
+	assert.Equal(t, "127.0.0.1:2004", bundle.Target)
+	assert.Equal(t, "me2@test.com", bundle.Options.From)
+	assert.Equal(t, "success", bundle.Tags["result"])
+	assert.Equal(t, float64(221), bundle.Fields["quit_code"])
+	// the address is not a hostname so only the reverse lookup is traced
+	require.Len(t, bundle.DNS, 1)
+	assert.Equal(t, "PTR", bundle.DNS[0].Type)
+	assert.Equal(t, "127.0.0.1", bundle.DNS[0].Name)
+	require.NotNil(t, bundle.TCP)
+	assert.Equal(t, "127.0.0.1:2004", bundle.TCP.RemoteAddress)
+	require.NotNil(t, bundle.TLS)
+	assert.NotEqual(t, "", bundle.TLS.Version)
+	assert.Len(t, bundle.TLS.PeerCertificates, 1)
+
+	// the transcript remains readable once the connection is encrypted
+	require.True(t, len(bundle.Transcript) > 4)
+	assert.Equal(t, "server", bundle.Transcript[0].Direction)
+	assert.Equal(t, "220 myhostname ESMTP Postfix (Ubuntu)\r\n", bundle.Transcript[0].Data)
+	assert.Equal(t, "client", bundle.Transcript[1].Direction)
+	assert.Equal(t, "EHLO me@test.com\r\n", bundle.Transcript[1].Data)
+	var starttls, mailFrom bool
+	for i, entry := range bundle.Transcript {
+		if entry.Data == "STARTTLS\r\n" {
+			starttls = true
+			assert.Equal(t, "220 2.1.0 Ok\r\n", bundle.Transcript[i+1].Data)
+			// the handshake is followed by a new ehlo
+			assert.Equal(t, "client", bundle.Transcript[i+2].Direction)
+			assert.Equal(t, "EHLO me@test.com\r\n", bundle.Transcript[i+2].Data)
+		}
+		if strings.HasPrefix(entry.Data, "MAIL FROM:<me2@test.com>") {
+			mailFrom = true
+			assert.True(t, starttls, "mail from sent before starttls")
+		}
+	}
+	assert.True(t, starttls, "starttls command missing from transcript")
+	assert.True(t, mailFrom, "mail from command missing from transcript")
+	assert.Equal(t, "QUIT\r\n", bundle.Transcript[len(bundle.Transcript)-2].Data)
+	assert.Equal(t, "221 2.0.0 Bye\r\n", bundle.Transcript[len(bundle.Transcript)-1].Data)
+}
+
+func TestWriteSupportBundle_MessageData(t *testing.T) {
+	var wg sync.WaitGroup
+	var acc testutil.Accumulator
+	dir, err := ioutil.TempDir("", "smtp_support_bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := getDefaultSmtpConfig()
+	c.Body = "testdata " + strings.Repeat("x", 10000)
+	c.MessagesPerSession = 3
+
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	// Start TCP server
+	wg.Add(1)
+	go SmtpServer(t, &wg, testConfig{})
+	wg.Wait()
+	// Connect
+	wg.Add(1)
+	path, err := c.writeSupportBundle(dir)
+	wg.Wait()
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var bundle supportBundle
+	require.NoError(t, json.Unmarshal(data, &bundle))
+	assert.Equal(t, "success", bundle.Tags["result"])
+
+	// only the size of each message is recorded, including its terminating line
+	var payloads int
+	for _, entry := range bundle.Transcript {
+		assert.NotContains(t, entry.Data, "xxxx")
+		if entry.Direction == "client" && strings.HasSuffix(entry.Data, "bytes message data]") {
+			payloads++
+			assert.Equal(t, fmt.Sprintf("[%d bytes message data]", len(c.Body)+5), entry.Data)
+		}
+	}
+	assert.Equal(t, 3, payloads)
+	assert.Equal(t, "QUIT\r\n", bundle.Transcript[len(bundle.Transcript)-2].Data)
+}
+
+func TestSupportBundle_Gather(t *testing.T) {
+	var wg sync.WaitGroup
+	var acc testutil.Accumulator
+	dir, err := ioutil.TempDir("", "smtp_support_bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	trigger := writeTrigger(t, "127.0.0.1:2004")
+	defer os.Remove(trigger)
+	c := getDefaultSmtpConfig()
+	c.SupportBundleTrigger = trigger
+	c.SupportBundleDir = dir
+
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	// Start TCP server
+	wg.Add(1)
+	go SmtpServer(t, &wg, testConfig{})
+	wg.Wait()
+	// The bundle is written in place of the regular session
+	wg.Add(1)
+	require.NoError(t, c.Gather(&acc))
+	wg.Wait()
+	c.sessions.wg.Wait()
+	require.NoError(t, acc.FirstError())
+	assert.Equal(t, uint64(0), acc.NMetrics())
+	assert.Equal(t, uint64(1), c.skippedGathers())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	_, err = os.Stat(trigger)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSupportBundle_Background(t *testing.T) {
+	var wg sync.WaitGroup
+	var acc testutil.Accumulator
+	dir, err := ioutil.TempDir("", "smtp_support_bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	trigger := writeTrigger(t, "")
+	defer os.Remove(trigger)
+	c := getDefaultSmtpConfig()
+	c.SupportBundleTrigger = trigger
+	c.SupportBundleDir = dir
+
+	require.NoError(t, c.Start(&acc))
+
+	// Start TCP server which never sends its greeting
+	wg.Add(1)
+	go SmtpServer(t, &wg, testConfig{connectionEndPhase: ConnectionTimeout})
+	wg.Wait()
+	wg.Add(1)
+	// The gather does not wait for the bundle of the stalled server
+	start := time.Now()
+	require.NoError(t, c.Gather(&acc))
+	assert.True(t, time.Since(start) < c.ReadTimeout.Duration)
+	// The interrupted bundle is not written and the trigger is kept to retry
+	c.Stop()
+	wg.Wait()
+	assert.NoError(t, acc.FirstError())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+	_, err = os.Stat(trigger)
+	assert.NoError(t, err)
+}
+
+func TestSupportBundle_UnknownTarget(t *testing.T) {
+	var acc testutil.Accumulator
+	trigger := writeTrigger(t, "mx.example.com:25\n")
+	defer os.Remove(trigger)
+	c := getDefaultSmtpConfig()
+	c.SupportBundleTrigger = trigger
+
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	require.NoError(t, c.Gather(&acc))
+	acc.Wait(1)
+	require.Error(t, acc.FirstError())
+	assert.Equal(t, `support bundle requested for unknown target "mx.example.com:25"`, acc.FirstError().Error())
+	// the trigger is consumed
+	_, err := os.Stat(trigger)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSupportBundle_TargetBusy(t *testing.T) {
+	var acc testutil.Accumulator
+	trigger := writeTrigger(t, "")
+	defer os.Remove(trigger)
+	c := getDefaultSmtpConfig()
+	c.SupportBundleTrigger = trigger
+	require.NoError(t, c.Start(&acc))
+	defer c.Stop()
+
+	// Simulate a session which is still running against the same server
+	require.True(t, c.acquire())
+	defer c.release()
+	require.NoError(t, c.handleSupportBundle())
+	// the trigger is kept to retry on the next interval
+	_, err := os.Stat(trigger)
+	assert.NoError(t, err)
+}
+
+func TestSupportBundle_NoTrigger(t *testing.T) {
+	c := getDefaultSmtpConfig()
+	c.SupportBundleTrigger = filepath.Join(os.TempDir(), "smtp_support_bundle_missing_trigger")
+	assert.NoError(t, c.handleSupportBundle())
+}
+
+func writeTrigger(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "smtp_support_bundle_trigger")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	return f.Name()
+}